@@ -0,0 +1,76 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/dgraph/protos"
+)
+
+func newSetEdge(facets []*protos.Facet) *protos.DirectedEdge {
+	return &protos.DirectedEdge{
+		Entity:  1,
+		Attr:    "name",
+		ValueId: 2,
+		Op:      protos.DirectedEdge_SET,
+		Facets:  facets,
+	}
+}
+
+func TestFacetsKeyOrderIndependent(t *testing.T) {
+	a := []*protos.Facet{{Key: "b", Value: []byte("2")}, {Key: "a", Value: []byte("1")}}
+	b := []*protos.Facet{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("2")}}
+	if facetsKey(a) != facetsKey(b) {
+		t.Fatalf("facetsKey should not depend on facet order: %q != %q", facetsKey(a), facetsKey(b))
+	}
+}
+
+func TestFacetsKeyContentSensitive(t *testing.T) {
+	a := []*protos.Facet{{Key: "since", Value: []byte("2020")}}
+	b := []*protos.Facet{{Key: "since", Value: []byte("2021")}}
+	if facetsKey(a) == facetsKey(b) {
+		t.Fatalf("facetsKey should distinguish facets with different values")
+	}
+}
+
+func TestEdgeKeyIgnoresFacetPointerIdentity(t *testing.T) {
+	// edgeKey must serialize facets by content: formatting edge.GetFacets()
+	// with %v on a []*protos.Facet prints pointer addresses, so two edges
+	// carrying logically identical facets (e.g. a bulk loader re-emitting the
+	// same triple) would never hash to the same key.
+	e1 := newSetEdge([]*protos.Facet{{Key: "since", Value: []byte("2020")}})
+	e2 := newSetEdge([]*protos.Facet{{Key: "since", Value: []byte("2020")}})
+	if edgeKey(e1) != edgeKey(e2) {
+		t.Fatalf("edgeKey of equivalent-but-distinct facet slices should match: %q != %q",
+			edgeKey(e1), edgeKey(e2))
+	}
+}
+
+func TestEdgeKeyDistinguishesDifferentFacets(t *testing.T) {
+	e1 := newSetEdge([]*protos.Facet{{Key: "since", Value: []byte("2020")}})
+	e2 := newSetEdge([]*protos.Facet{{Key: "since", Value: []byte("2021")}})
+	if edgeKey(e1) == edgeKey(e2) {
+		t.Fatalf("edgeKey should not collide for edges with different facet values")
+	}
+}
+
+func TestDedupEdgesDropsExactDuplicates(t *testing.T) {
+	e1 := newSetEdge([]*protos.Facet{{Key: "since", Value: []byte("2020")}})
+	e2 := newSetEdge([]*protos.Facet{{Key: "since", Value: []byte("2020")}}) // duplicate of e1
+	e3 := newSetEdge([]*protos.Facet{{Key: "since", Value: []byte("2021")}}) // distinct facet
+	m := &protos.Mutations{Edges: []*protos.DirectedEdge{e1, e2, e3}}
+
+	dropped := dedupEdges(m)
+	if dropped != 1 {
+		t.Fatalf("expected 1 duplicate dropped, got %d", dropped)
+	}
+	if len(m.Edges) != 2 {
+		t.Fatalf("expected 2 edges to remain, got %d", len(m.Edges))
+	}
+}
+
+func TestDedupEdgesNoop(t *testing.T) {
+	m := &protos.Mutations{}
+	if dropped := dedupEdges(m); dropped != 0 {
+		t.Fatalf("expected 0 duplicates dropped for an empty mutation, got %d", dropped)
+	}
+}
@@ -3,8 +3,13 @@ package query
 import (
 	"context"
 	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/trace"
 
@@ -17,6 +22,15 @@ import (
 	"github.com/dgraph-io/dgraph/x"
 )
 
+var uidPrefetchBatch = flag.Int("uid_prefetch_batch", 10000,
+	"Number of uids to lease from Zero at a time and hand out locally, "+
+		"instead of round-tripping to Zero for every mutation.")
+
+var (
+	uidPoolHits   = expvar.NewInt("dgraph_uid_pool_hits_total")
+	uidPoolMisses = expvar.NewInt("dgraph_uid_pool_misses_total")
+)
+
 func ApplyMutations(ctx context.Context, m *protos.Mutations) (*protos.TxnContext, error) {
 	if worker.Config.ExpandEdge {
 		edges, err := expandEdges(ctx, m)
@@ -27,94 +41,301 @@ func ApplyMutations(ctx context.Context, m *protos.Mutations) (*protos.TxnContex
 		if tr, ok := trace.FromContext(ctx); ok {
 			tr.LazyPrintf("Added Internal edges")
 		}
-	} else {
-		for _, mu := range m.Edges {
-			if mu.Attr == x.Star && !worker.Config.ExpandEdge {
-				return nil, x.Errorf("Expand edge (--expand_edge) is set to false." +
-					" Cannot perform S * * deletion.")
-			}
+	} else if err := rejectWildcardEdgesIfExpandDisabled(m.Edges); err != nil {
+		return nil, err
+	}
+
+	numDupes := dedupEdges(m)
+	if numDupes > 0 {
+		if tr, ok := trace.FromContext(ctx); ok {
+			tr.LazyPrintf("Dropped %d duplicate edges before MutateOverNetwork", numDupes)
 		}
 	}
+
 	tctx, err := worker.MutateOverNetwork(ctx, m)
 	if err != nil {
 		if tr, ok := trace.FromContext(ctx); ok {
 			tr.LazyPrintf("Error while MutateOverNetwork: %+v", err)
 		}
 	}
+	if tctx != nil {
+		tctx.NumDuplicateEdges = uint32(numDupes)
+	}
 	return tctx, err
 }
 
+// EntrySet groups the edges for a single subject. It is the unit of work
+// ApplyMutationStream consumes, so a bulk loader never has to buffer an
+// entire protos.Mutations in memory. No RPC in this package decodes
+// EntrySets off the wire; callers build them and send them on a channel.
+type EntrySet struct {
+	StartTs uint64
+	Edges   []*protos.DirectedEdge
+}
+
+// ApplyMutationStream applies a stream of EntrySets incrementally, instead
+// of requiring the caller to buffer an entire protos.Mutations up front.
+// Each entry set is applied with its own StartTs, so the sets form a single
+// transaction only when they all carry the same StartTs. Every ackEvery
+// entry sets (or after every entry set, if ackEvery <= 0) it calls progress
+// with the TxnContext accumulated so far.
+//
+// Edge expansion happens per entry set via expandEdges, since the whole
+// stream is never materialized at once. Bookkeeping across entry sets is
+// accumulated through a txnContextMerger rather than a raw append, so memory
+// stays bounded by the number of distinct keys/predicates touched rather
+// than growing duplicate-for-duplicate with every entry set processed --
+// the thing a multi-GB, many-entry-set import needs to avoid OOMing.
+func ApplyMutationStream(ctx context.Context, entries <-chan *EntrySet, ackEvery int,
+	progress func(*protos.TxnContext)) (*protos.TxnContext, error) {
+
+	merger := newTxnContextMerger()
+	count := 0
+	for es := range entries {
+		m := &protos.Mutations{Edges: es.Edges, StartTs: es.StartTs}
+		if worker.Config.ExpandEdge {
+			expanded, err := expandEdges(ctx, m)
+			if err != nil {
+				return merger.final, x.Wrapf(err, "While adding internal edges")
+			}
+			m.Edges = expanded
+		} else if err := rejectWildcardEdgesIfExpandDisabled(m.Edges); err != nil {
+			return merger.final, err
+		}
+		numDupes := dedupEdges(m)
+
+		tctx, err := worker.MutateOverNetwork(ctx, m)
+		if err != nil {
+			return merger.final, err
+		}
+		if tctx != nil {
+			tctx.NumDuplicateEdges += uint32(numDupes)
+		}
+		merger.merge(tctx)
+
+		count++
+		if progress != nil && (ackEvery <= 0 || count%ackEvery == 0) {
+			progress(merger.final)
+		}
+	}
+	return merger.final, nil
+}
+
+// txnContextMerger folds a sequence of TxnContexts returned by successive
+// MutateOverNetwork calls into one running TxnContext, deduplicating Keys
+// and Preds as they come in. Without dedup, final.Keys/final.Preds would
+// grow by the raw count of (possibly repeated) keys touched across every
+// entry set in the stream, held in memory for the life of the transaction --
+// exactly the OOM streaming ingest is meant to avoid. Deduping bounds memory
+// to the number of distinct keys/predicates the transaction actually
+// touches, which is the real floor for conflict detection at commit time;
+// it does not bound total memory for a transaction touching a genuinely
+// unbounded number of distinct keys, which must instead be addressed by
+// committing and starting a new transaction periodically.
+type txnContextMerger struct {
+	final     *protos.TxnContext
+	seenKeys  map[string]struct{}
+	seenPreds map[string]struct{}
+}
+
+func newTxnContextMerger() *txnContextMerger {
+	return &txnContextMerger{
+		final:     &protos.TxnContext{},
+		seenKeys:  make(map[string]struct{}),
+		seenPreds: make(map[string]struct{}),
+	}
+}
+
+func (t *txnContextMerger) merge(src *protos.TxnContext) {
+	if src == nil {
+		return
+	}
+	t.final.StartTs = src.StartTs
+	t.final.NumDuplicateEdges += src.NumDuplicateEdges
+	for _, k := range src.Keys {
+		if _, ok := t.seenKeys[k]; ok {
+			continue
+		}
+		t.seenKeys[k] = struct{}{}
+		t.final.Keys = append(t.final.Keys, k)
+	}
+	for _, p := range src.Preds {
+		if _, ok := t.seenPreds[p]; ok {
+			continue
+		}
+		t.seenPreds[p] = struct{}{}
+		t.final.Preds = append(t.final.Preds, p)
+	}
+}
+
+// rejectWildcardEdgesIfExpandDisabled returns an error if any edge uses the
+// S * * wildcard deletion form, which can only be resolved into concrete
+// edges by expandEdges -- callers must reject it up front whenever
+// --expand_edge is disabled, instead of letting it reach MutateOverNetwork
+// unexpanded.
+func rejectWildcardEdgesIfExpandDisabled(edges []*protos.DirectedEdge) error {
+	for _, mu := range edges {
+		if mu.Attr == x.Star {
+			return x.Errorf("Expand edge (--expand_edge) is set to false." +
+				" Cannot perform S * * deletion.")
+		}
+	}
+	return nil
+}
+
+// dedupEdges drops exact duplicate edges from m.Edges in place, keeping the
+// first occurrence of each (Entity, Attr, ValueId/Value, Op, Ordinal, Facets)
+// tuple.
+// It returns the number of edges dropped so callers can surface it to the
+// client as a warning, mirroring the dedup-on-append pattern used when
+// merging edge groups elsewhere in the storage layer.
+func dedupEdges(m *protos.Mutations) int {
+	if len(m.Edges) == 0 {
+		return 0
+	}
+	seen := make(map[string]struct{}, len(m.Edges))
+	deduped := m.Edges[:0]
+	dropped := 0
+	for _, edge := range m.Edges {
+		key := edgeKey(edge)
+		if _, ok := seen[key]; ok {
+			dropped++
+			continue
+		}
+		seen[key] = struct{}{}
+		deduped = append(deduped, edge)
+	}
+	m.Edges = deduped
+	return dropped
+}
+
+// edgeKey returns a canonical string key identifying an edge for dedup
+// purposes, including its facets so a SET with different facets is not
+// mistaken for a true duplicate. Facets are serialized by content (sorted by
+// key) rather than formatted with %v, since %v over a []*protos.Facet prints
+// pointer addresses and would make two edges with identical facets hash to
+// different keys.
+func edgeKey(edge *protos.DirectedEdge) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d|%s|%d|%s|%d|%d|",
+		edge.GetEntity(), edge.GetAttr(), edge.GetValueId(), edge.GetValue(),
+		edge.GetOp(), edge.GetOrdinal())
+	sb.WriteString(facetsKey(edge.GetFacets()))
+	return sb.String()
+}
+
+// facetsKey serializes a list of facets by content, sorted by key so that
+// the same set of facets produces the same string regardless of the order
+// they were attached in.
+func facetsKey(fs []*protos.Facet) string {
+	if len(fs) == 0 {
+		return ""
+	}
+	sorted := append([]*protos.Facet(nil), fs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	var sb strings.Builder
+	for _, f := range sorted {
+		fmt.Fprintf(&sb, "%s=%s;", f.Key, f.Value)
+	}
+	return sb.String()
+}
+
 func expandEdges(ctx context.Context, m *protos.Mutations) ([]*protos.DirectedEdge, error) {
 	edges := make([]*protos.DirectedEdge, 0, 2*len(m.Edges))
 	for _, edge := range m.Edges {
-		x.AssertTrue(edge.Op == protos.DirectedEdge_DEL || edge.Op == protos.DirectedEdge_SET)
+		expanded, err := expandEdge(ctx, m, edge)
+		if err != nil {
+			return nil, err
+		}
+		edges = append(edges, expanded...)
+	}
+	return edges, nil
+}
+
+// expandEdge expands a single input edge into the internal edges it
+// implies: predicate-wildcard (S * *) expansion, the _predicate_ tracking
+// edge, and any reverse-predicate tracking edges. expandEdges calls it once
+// per input edge; it has no other caller.
+func expandEdge(ctx context.Context, m *protos.Mutations,
+	edge *protos.DirectedEdge) ([]*protos.DirectedEdge, error) {
 
-		if edge.Op == protos.DirectedEdge_DEL && edge.Entity == 0 && string(edge.GetValue()) == x.Star {
-			// * P * case. Not allowed via mutations. This is rejected later,
-			// so just pass it on for now.
-			edges = append(edges, edge)
+	x.AssertTrue(edge.Op == protos.DirectedEdge_DEL || edge.Op == protos.DirectedEdge_SET)
+
+	var edges []*protos.DirectedEdge
+	if edge.Op == protos.DirectedEdge_DEL && edge.Entity == 0 && string(edge.GetValue()) == x.Star {
+		// * P * case. Not allowed via mutations. This is rejected later,
+		// so just pass it on for now.
+		return append(edges, edge), nil
+	}
+
+	var preds []string
+	if edge.Attr != x.Star {
+		preds = []string{edge.Attr}
+	} else {
+		sg := &SubGraph{}
+		sg.DestUIDs = &protos.List{[]uint64{edge.GetEntity()}}
+		sg.ReadTs = m.StartTs
+		valMatrix, err := getNodePredicates(ctx, sg)
+		if err != nil {
+			return nil, err
+		}
+		if len(valMatrix) != 1 {
+			return nil, x.Errorf("Expected only one list in value matrix while deleting: %v",
+				edge.GetEntity())
+		}
+		for _, tv := range valMatrix[0].Values {
+			if len(tv.Val) > 0 {
+				preds = append(preds, string(tv.Val))
+			}
+		}
+	}
+
+	for _, pred := range preds {
+		// edgeCopy and the reverse _predicate_ edge below both carry
+		// edge.Ordinal forward unchanged. This is inert plumbing, not a
+		// working feature yet: nothing in this tree ever sets Ordinal to a
+		// nonzero value, since gql.NQuad.ToEdgeUsing (which the ordinal
+		// request asks to extend) isn't part of this series. Two SET
+		// mutations on the same (Entity, Attr, ValueId) still collide exactly
+		// as before until ToEdgeUsing, the posting-list key, and the
+		// @ordinal() query filter are implemented.
+		edgeCopy := *edge
+		edgeCopy.Attr = pred
+		edges = append(edges, &edgeCopy)
+
+		e := &protos.DirectedEdge{
+			Op:     edge.Op,
+			Entity: edge.GetEntity(),
+			Attr:   "_predicate_",
+			Value:  []byte(pred),
+		}
+		edges = append(edges, e)
+
+		if !schema.State().IsReversed(pred) {
 			continue
 		}
 
-		var preds []string
-		if edge.Attr != x.Star {
-			preds = []string{edge.Attr}
+		var objs []uint64
+		if string(edge.GetValue()) != x.Star {
+			objs = []uint64{edge.GetValueId()}
 		} else {
-			sg := &SubGraph{}
-			sg.DestUIDs = &protos.List{[]uint64{edge.GetEntity()}}
-			sg.ReadTs = m.StartTs
-			valMatrix, err := getNodePredicates(ctx, sg)
+			plist := posting.Get(x.DataKey(pred, edge.GetEntity()))
+			list, err := plist.Uids(posting.ListOptions{ReadTs: m.GetStartTs()})
 			if err != nil {
 				return nil, err
 			}
-			if len(valMatrix) != 1 {
-				return nil, x.Errorf("Expected only one list in value matrix while deleting: %v",
-					edge.GetEntity())
-			}
-			for _, tv := range valMatrix[0].Values {
-				if len(tv.Val) > 0 {
-					preds = append(preds, string(tv.Val))
-				}
-			}
+			objs = list.Uids
 		}
-
-		for _, pred := range preds {
-			edgeCopy := *edge
-			edgeCopy.Attr = pred
-			edges = append(edges, &edgeCopy)
-
-			e := &protos.DirectedEdge{
-				Op:     edge.Op,
-				Entity: edge.GetEntity(),
-				Attr:   "_predicate_",
-				Value:  []byte(pred),
+		for _, obj := range objs {
+			e = &protos.DirectedEdge{
+				Op:      edge.Op,
+				Entity:  obj,
+				Attr:    "_predicate_",
+				Value:   []byte("~" + pred),
+				Ordinal: edge.Ordinal,
 			}
 			edges = append(edges, e)
-
-			if !schema.State().IsReversed(pred) {
-				continue
-			}
-
-			var objs []uint64
-			if string(edge.GetValue()) != x.Star {
-				objs = []uint64{edge.GetValueId()}
-			} else {
-				plist := posting.Get(x.DataKey(pred, edge.GetEntity()))
-				list, err := plist.Uids(posting.ListOptions{ReadTs: m.GetStartTs()})
-				if err != nil {
-					return nil, err
-				}
-				objs = list.Uids
-			}
-			for _, obj := range objs {
-				e = &protos.DirectedEdge{
-					Op:     edge.Op,
-					Entity: obj,
-					Attr:   "_predicate_",
-					Value:  []byte("~" + pred),
-				}
-				edges = append(edges, e)
-			}
 		}
 	}
 	return edges, nil
@@ -130,6 +351,128 @@ func verifyUid(uid uint64) error {
 	return nil
 }
 
+// refillWatermark is the fraction of a batch below which uidAllocator kicks
+// off an asynchronous refill from Zero, so that assign() rarely has to block
+// on a synchronous round-trip.
+const refillWatermark = 0.2
+
+// refillTimeout bounds the background refill's AssignUidsOverNetwork call.
+// The refill runs detached from the triggering request's context (which is
+// typically canceled as soon as that request returns, well before the
+// refill's round-trip to Zero would complete), so it needs its own deadline
+// instead of inheriting one.
+const refillTimeout = 10 * time.Second
+
+// uidAllocator pre-leases uids from Zero in batches (--uid_prefetch_batch)
+// and hands them out from an in-memory range, so AssignUids can satisfy most
+// requests with a local map allocation instead of a network hop to Zero for
+// every mutation.
+//
+// A background refill lands its leased batch in pending* rather than
+// installing it directly into next/end: the refill can return at any point
+// relative to the current range being drawn down, and staging it lets
+// assign() swap it in exactly when the current range is exhausted, instead
+// of requiring the refill to land at that exact moment (which it almost
+// never does under sustained load, so the lease would otherwise be dropped
+// on the floor on nearly every refill).
+type uidAllocator struct {
+	sync.Mutex
+	next, end                uint64
+	pendingStart, pendingEnd uint64
+	hasPending               bool
+	refilling                bool
+}
+
+var uidPool = &uidAllocator{}
+
+// takeLocked draws n uids from the current range, swapping in the pending
+// range first if the current one can't cover the request and the pending
+// one can. Must be called
+// with a.Mutex held.
+func (a *uidAllocator) takeLocked(n uint64) (uint64, bool) {
+	if a.end-a.next < n && a.hasPending && a.pendingEnd-a.pendingStart >= n {
+		a.next, a.end = a.pendingStart, a.pendingEnd
+		a.hasPending = false
+	}
+	if a.end-a.next >= n {
+		start := a.next
+		a.next += n
+		return start, true
+	}
+	return 0, false
+}
+
+// assign returns the first of n contiguous uids, leasing a fresh batch from
+// Zero if neither the local pool nor a staged pending batch can cover the
+// request, and kicking off an asynchronous refill once the pool runs low.
+func (a *uidAllocator) assign(ctx context.Context, n uint64) (uint64, error) {
+	a.Lock()
+	start, ok := a.takeLocked(n)
+	if ok {
+		low := !a.hasPending && a.end-a.next < uint64(float64(*uidPrefetchBatch)*refillWatermark)
+		shouldRefill := low && !a.refilling
+		if shouldRefill {
+			a.refilling = true
+		}
+		a.Unlock()
+
+		uidPoolHits.Add(int64(n))
+		if shouldRefill {
+			// Detach from ctx: it belongs to the request that triggered this
+			// refill and is typically canceled the moment that request
+			// returns, long before AssignUidsOverNetwork's round-trip to Zero
+			// would complete.
+			go a.refill(context.Background())
+		}
+		return start, nil
+	}
+	a.Unlock()
+
+	uidPoolMisses.Add(int64(n))
+	batch := uint64(*uidPrefetchBatch)
+	if n > batch {
+		batch = n
+	}
+	res, err := worker.AssignUidsOverNetwork(ctx, &protos.Num{Val: batch})
+	if err != nil {
+		return 0, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	start = res.StartId
+	a.next = start + n
+	a.end = res.EndId
+	return start, nil
+}
+
+// refill leases a fresh batch from Zero in the background and stages it in
+// pendingStart/pendingEnd for assign() to swap in once the current range
+// runs dry. It never touches next/end directly, so it can't clobber uids a
+// concurrent synchronous miss just installed.
+func (a *uidAllocator) refill(ctx context.Context) {
+	defer func() {
+		a.Lock()
+		a.refilling = false
+		a.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, refillTimeout)
+	defer cancel()
+
+	res, err := worker.AssignUidsOverNetwork(ctx, &protos.Num{Val: uint64(*uidPrefetchBatch)})
+	if err != nil {
+		// Leave the existing pool as-is; the next assign() call will fall back
+		// to a synchronous round-trip if it runs dry.
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.pendingStart, a.pendingEnd = res.StartId, res.EndId
+	a.hasPending = true
+}
+
 func AssignUids(ctx context.Context, nquads []*protos.NQuad) (map[string]uint64, error) {
 	newUids := make(map[string]uint64)
 	num := &protos.Num{}
@@ -167,19 +510,16 @@ func AssignUids(ctx context.Context, nquads []*protos.NQuad) (map[string]uint64,
 
 	num.Val = uint64(len(newUids))
 	if int(num.Val) > 0 {
-		var res *protos.AssignedIds
-		// TODO: Optimize later by prefetching. Also consolidate all the UID requests into a single
-		// pending request from this server to zero.
-		if res, err = worker.AssignUidsOverNetwork(ctx, num); err != nil {
+		curId, err := uidPool.assign(ctx, num.Val)
+		if err != nil {
 			if tr, ok := trace.FromContext(ctx); ok {
-				tr.LazyPrintf("Error while AssignUidsOverNetwork for newUids: %+v", err)
+				tr.LazyPrintf("Error while assigning newUids: %+v", err)
 			}
 			return newUids, err
 		}
-		curId := res.StartId
 		// assign generated ones now
 		for k := range newUids {
-			x.AssertTruef(curId != 0 && curId <= res.EndId, "not enough uids generated")
+			x.AssertTruef(curId != 0, "not enough uids generated")
 			newUids[k] = curId
 			curId++
 		}
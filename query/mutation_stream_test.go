@@ -0,0 +1,59 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/dgraph/protos"
+	"github.com/dgraph-io/dgraph/x"
+)
+
+func TestRejectWildcardEdgesIfExpandDisabled(t *testing.T) {
+	wildcard := []*protos.DirectedEdge{
+		{Entity: 1, Attr: "name", Op: protos.DirectedEdge_SET},
+		{Entity: 2, Attr: x.Star, Op: protos.DirectedEdge_DEL},
+	}
+	if err := rejectWildcardEdgesIfExpandDisabled(wildcard); err == nil {
+		t.Fatalf("expected an error for an S * * edge when expand_edge is disabled")
+	}
+
+	concrete := []*protos.DirectedEdge{
+		{Entity: 1, Attr: "name", Op: protos.DirectedEdge_SET},
+	}
+	if err := rejectWildcardEdgesIfExpandDisabled(concrete); err != nil {
+		t.Fatalf("unexpected error for non-wildcard edges: %v", err)
+	}
+}
+
+func TestTxnContextMergerDedupesKeysAndPreds(t *testing.T) {
+	merger := newTxnContextMerger()
+	merger.merge(&protos.TxnContext{
+		StartTs:           7,
+		Keys:              []string{"k1", "k2"},
+		Preds:             []string{"name"},
+		NumDuplicateEdges: 1,
+	})
+	merger.merge(&protos.TxnContext{
+		StartTs:           7,
+		Keys:              []string{"k2", "k3"},
+		Preds:             []string{"name", "age"},
+		NumDuplicateEdges: 2,
+	})
+
+	if len(merger.final.Keys) != 3 {
+		t.Fatalf("expected 3 distinct keys, got %d: %v", len(merger.final.Keys), merger.final.Keys)
+	}
+	if len(merger.final.Preds) != 2 {
+		t.Fatalf("expected 2 distinct preds, got %d: %v", len(merger.final.Preds), merger.final.Preds)
+	}
+	if merger.final.NumDuplicateEdges != 3 {
+		t.Fatalf("expected NumDuplicateEdges to accumulate to 3, got %d", merger.final.NumDuplicateEdges)
+	}
+}
+
+func TestTxnContextMergerIgnoresNil(t *testing.T) {
+	merger := newTxnContextMerger()
+	merger.merge(nil)
+	if merger.final.Keys != nil || merger.final.Preds != nil {
+		t.Fatalf("merging a nil TxnContext should be a no-op")
+	}
+}
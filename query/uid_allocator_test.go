@@ -0,0 +1,93 @@
+package query
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestUidAllocatorAssignFromLocalPool(t *testing.T) {
+	a := &uidAllocator{next: 100, end: 110}
+	start, err := a.assign(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if start != 100 {
+		t.Fatalf("expected start 100, got %d", start)
+	}
+	if a.next != 105 {
+		t.Fatalf("expected next to advance to 105, got %d", a.next)
+	}
+}
+
+func TestUidAllocatorSwapsInPendingRangeOnExhaustion(t *testing.T) {
+	// Only 2 uids left in the current range, but a refill already staged a
+	// pending batch -- assign() must swap it in rather than discarding it
+	// because it didn't land at the exact moment of exhaustion.
+	a := &uidAllocator{
+		next: 100, end: 102,
+		pendingStart: 1000, pendingEnd: 1010,
+		hasPending: true,
+	}
+	start, err := a.assign(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if start != 1000 {
+		t.Fatalf("expected assign to draw from the swapped-in pending range starting at 1000, got %d", start)
+	}
+	if a.hasPending {
+		t.Fatalf("pending range should be consumed once swapped in")
+	}
+	if a.next != 1005 || a.end != 1010 {
+		t.Fatalf("expected pool to advance from the pending range, got next=%d end=%d", a.next, a.end)
+	}
+}
+
+func TestUidAllocatorKeepsPendingWhenCurrentRangeSuffices(t *testing.T) {
+	a := &uidAllocator{
+		next: 100, end: 200,
+		pendingStart: 1000, pendingEnd: 1010,
+		hasPending: true,
+	}
+	start, err := a.assign(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if start != 100 {
+		t.Fatalf("expected assign to prefer the current range while it suffices, got %d", start)
+	}
+	if !a.hasPending || a.pendingStart != 1000 || a.pendingEnd != 1010 {
+		t.Fatalf("pending range should be left untouched until the current range is exhausted")
+	}
+}
+
+func TestUidAllocatorConcurrentAssignNeverDoubleAllocates(t *testing.T) {
+	// end is large relative to what's consumed below so the watermark refill
+	// never fires, keeping this test free of network calls.
+	a := &uidAllocator{next: 0, end: 1000000}
+
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start, err := a.assign(context.Background(), 10)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for u := start; u < start+10; u++ {
+				if seen[u] {
+					t.Errorf("uid %d assigned to more than one caller", u)
+				}
+				seen[u] = true
+			}
+		}()
+	}
+	wg.Wait()
+}